@@ -1,19 +1,27 @@
 package environment
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/Azure/go-ansiterm/winterm"
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 )
 
+// Root reports whether the Administrators group is enabled in the current
+// token. Under UAC, a non-elevated shell of an admin user holds that group
+// only as deny-only, so Root reports false there; use Elevation to tell that
+// case apart from a non-admin user.
 func (env *ShellEnvironment) Root() bool {
 	defer env.Trace(time.Now(), "Root")
 	var sid *windows.SID
@@ -51,6 +59,123 @@ func (env *ShellEnvironment) Root() bool {
 	return member
 }
 
+// IntegrityLevel is the mandatory integrity level of the current token, as
+// reported by TokenIntegrityLevel.
+type IntegrityLevel string
+
+const (
+	IntegrityLow    IntegrityLevel = "Low"
+	IntegrityMedium IntegrityLevel = "Medium"
+	IntegrityHigh   IntegrityLevel = "High"
+	IntegritySystem IntegrityLevel = "System"
+)
+
+// ElevationInfo reports the current process' elevation state in more detail
+// than a single bool can, so templates can distinguish e.g. "elevated" from
+// "admin account, but running in a non-elevated shell".
+type ElevationInfo struct {
+	IsAdmin              bool
+	IsElevated           bool
+	IntegrityLevel       IntegrityLevel
+	LinkedTokenAvailable bool
+	UACEnabled           bool
+}
+
+type tokenElevationTypeValue uint32
+
+const (
+	tokenElevationTypeDefault tokenElevationTypeValue = 1
+	tokenElevationTypeFull    tokenElevationTypeValue = 2
+	tokenElevationTypeLimited tokenElevationTypeValue = 3
+)
+
+func tokenElevationType(token windows.Token) (tokenElevationTypeValue, error) {
+	var value tokenElevationTypeValue
+	var returnedLen uint32
+	err := windows.GetTokenInformation(token, windows.TokenElevationType, (*byte)(unsafe.Pointer(&value)), uint32(unsafe.Sizeof(value)), &returnedLen)
+	return value, err
+}
+
+// tokenMandatoryLabel mirrors the Win32 TOKEN_MANDATORY_LABEL struct, which
+// golang.org/x/sys/windows doesn't expose.
+type tokenMandatoryLabel struct {
+	Label windows.SIDAndAttributes
+}
+
+// The well-known mandatory integrity RIDs; x/sys/windows doesn't define
+// these either.
+const (
+	securityMandatoryLowRID    = 0x1000
+	securityMandatoryMediumRID = 0x2000
+	securityMandatoryHighRID   = 0x3000
+	securityMandatorySystemRID = 0x4000
+)
+
+func tokenIntegrityLevel(token windows.Token) (IntegrityLevel, error) {
+	var returnedLen uint32
+	// A TOKEN_MANDATORY_LABEL plus room for the SID fits comfortably in 64 bytes.
+	info := make([]byte, 64)
+	if err := windows.GetTokenInformation(token, windows.TokenIntegrityLevel, &info[0], uint32(len(info)), &returnedLen); err != nil {
+		return "", err
+	}
+
+	label := (*tokenMandatoryLabel)(unsafe.Pointer(&info[0]))
+	sid := (*windows.SID)(unsafe.Pointer(label.Label.Sid))
+	rid := sid.SubAuthority(uint32(sid.SubAuthorityCount()) - 1)
+
+	switch {
+	case rid < securityMandatoryMediumRID:
+		return IntegrityLow, nil
+	case rid < securityMandatoryHighRID:
+		return IntegrityMedium, nil
+	case rid < securityMandatorySystemRID:
+		return IntegrityHigh, nil
+	default:
+		return IntegritySystem, nil
+	}
+}
+
+func (env *ShellEnvironment) uacEnabled() bool {
+	value, err := env.WindowsRegistryKeyValue(`HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\Policies\System\EnableLUA`)
+	if err != nil {
+		// UAC has been on by default since Vista; assume enabled when the
+		// policy key can't be read rather than reporting a misleading "off".
+		return true
+	}
+	return value.DWord != 0
+}
+
+// Elevation reports the current process' elevation state: whether the user
+// is an administrator, whether this particular process is running elevated,
+// the token's mandatory integrity level, whether a linked token is available
+// (i.e. UAC split-token is in play), and whether UAC itself is enabled.
+func (env *ShellEnvironment) Elevation() *ElevationInfo {
+	defer env.Trace(time.Now(), "Elevation")
+
+	info := &ElevationInfo{
+		IsAdmin:    env.Root(),
+		UACEnabled: env.uacEnabled(),
+	}
+
+	token := windows.Token(0)
+
+	info.IsElevated = token.IsElevated()
+
+	if elevationType, err := tokenElevationType(token); err == nil {
+		info.LinkedTokenAvailable = elevationType != tokenElevationTypeDefault
+	} else {
+		env.Log(Error, "Elevation", err.Error())
+	}
+
+	if level, err := tokenIntegrityLevel(token); err == nil {
+		info.IntegrityLevel = level
+	} else {
+		env.Log(Error, "Elevation", err.Error())
+	}
+
+	return info
+}
+
 func (env *ShellEnvironment) Home() string {
 	home := os.Getenv("HOME")
 	defer func() {
@@ -76,6 +201,117 @@ func (env *ShellEnvironment) QueryWindowTitles(processName, windowTitleRegex str
 	return title, err
 }
 
+// WindowInfo describes a window and the process behind it, for segments that
+// want to render a focused-window indicator or a per-process badge instead
+// of a bare title string.
+type WindowInfo struct {
+	Title       string
+	PID         uint32
+	ProcessName string
+	ExePath     string
+	IsElevated  bool
+	HWND        windows.HWND
+}
+
+var (
+	user32             = windows.NewLazySystemDLL("user32.dll")
+	procGetWindowTextW = user32.NewProc("GetWindowTextW")
+)
+
+func getWindowThreadProcessID(hwnd windows.HWND) (pid uint32, err error) {
+	tid, callErr := windows.GetWindowThreadProcessId(hwnd, &pid)
+	if tid == 0 {
+		return 0, callErr
+	}
+	return pid, nil
+}
+
+func getWindowText(hwnd windows.HWND) string {
+	buf := make([]uint16, 256)
+	n, _, _ := procGetWindowTextW.Call(uintptr(hwnd), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	return syscall.UTF16ToString(buf[:n])
+}
+
+func queryFullProcessImageName(process windows.Handle) (string, error) {
+	buf := make([]uint16, windows.MAX_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(process, 0, &buf[0], &size); err != nil {
+		return "", err
+	}
+	return syscall.UTF16ToString(buf[:size]), nil
+}
+
+func processIsElevated(process windows.Handle) bool {
+	var token windows.Token
+	if err := windows.OpenProcessToken(process, windows.TOKEN_QUERY, &token); err != nil {
+		return false
+	}
+	defer token.Close()
+
+	return token.IsElevated()
+}
+
+func windowInfoFromHWND(hwnd windows.HWND) (*WindowInfo, error) {
+	if hwnd == 0 {
+		return nil, errors.New("invalid window handle")
+	}
+
+	pid, err := getWindowThreadProcessID(hwnd)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &WindowInfo{Title: getWindowText(hwnd), PID: pid, HWND: hwnd}
+
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return info, nil
+	}
+	defer windows.CloseHandle(process)
+
+	if exePath, err := queryFullProcessImageName(process); err == nil {
+		info.ExePath = exePath
+		info.ProcessName = filepath.Base(exePath)
+	}
+	info.IsElevated = processIsElevated(process)
+
+	return info, nil
+}
+
+// ForegroundWindow returns info about the window currently in the
+// foreground, e.g. to render a "focused window" segment.
+func (env *ShellEnvironment) ForegroundWindow() (*WindowInfo, error) {
+	defer env.Trace(time.Now(), "ForegroundWindow")
+
+	hwnd := windows.GetForegroundWindow()
+
+	info, err := windowInfoFromHWND(hwnd)
+	if err != nil {
+		env.Log(Error, "ForegroundWindow", err.Error())
+	}
+	return info, err
+}
+
+// ShellWindowPID returns the PID owning the desktop shell window (normally
+// explorer.exe), which is useful to detect whether the terminal is running
+// under the interactive desktop shell versus a service session.
+func (env *ShellEnvironment) ShellWindowPID() (uint32, error) {
+	defer env.Trace(time.Now(), "ShellWindowPID")
+
+	hwnd := windows.GetShellWindow()
+	if hwnd == 0 {
+		err := errors.New("no shell window")
+		env.Log(Error, "ShellWindowPID", err.Error())
+		return 0, err
+	}
+
+	pid, err := getWindowThreadProcessID(hwnd)
+	if err != nil {
+		env.Log(Error, "ShellWindowPID", err.Error())
+	}
+	return pid, err
+}
+
 func (env *ShellEnvironment) IsWsl() bool {
 	defer env.Trace(time.Now(), "IsWsl")
 	return false
@@ -131,68 +367,54 @@ func (env *ShellEnvironment) LookWinAppPath(file string) (string, error) {
 	return "", errors.New("no Windows Store App")
 }
 
-// Takes a registry path to a key like
+// parseRegistryPath splits a path like
 //
 //	"HKLM\Software\Microsoft\Windows NT\CurrentVersion\EditionID"
+//	  1  |                  2                         |   3
 //
-// The last part of the path is the key to retrieve.
+// into:
 //
-// If the path ends in "\", the "(Default)" key in that path is retrieved.
+// 1. Root key - the root HKEY string, turned into a handle
+// 2. Path - the key to open
+// 3. Key - the value name to read from that key
 //
-// Returns a variant type if successful; nil and an error if not.
-func (env *ShellEnvironment) WindowsRegistryKeyValue(path string) (*WindowsRegistryValue, error) {
-	env.Trace(time.Now(), "WindowsRegistryKeyValue", path)
-
-	// Format:
-	// "HKLM\Software\Microsoft\Windows NT\CurrentVersion\EditionID"
-	//   1  |                  2                         |   3
-	//
-	// Split into:
-	//
-	// 1. Root key - extract the root HKEY string and turn this into a handle to get started
-	// 2. Path - open this path
-	// 3. Key - get this key value
-	//
-	// If 3 is "" (i.e. the path ends with "\"), then get (Default) key.
-	//
+// If 3 is "" (i.e. the path ends with "\"), the (Default) value is read.
+func parseRegistryPath(env *ShellEnvironment, path string) (root registry.Key, regPath, regKey string, err error) {
 	rootKey, regPath, found := strings.Cut(path, `\`)
 	if !found {
 		errorLogMsg := fmt.Sprintf("Error, malformed registry path: '%s'", path)
-		env.Log(Error, "WindowsRegistryKeyValue", errorLogMsg)
-		return nil, errors.New(errorLogMsg)
+		return 0, "", "", errors.New(errorLogMsg)
 	}
 
-	regKey := Base(env, regPath)
+	regKey = Base(env, regPath)
 	if len(regKey) != 0 {
 		regPath = strings.TrimSuffix(regPath, `\`+regKey)
 	}
 
-	var key registry.Key
 	switch rootKey {
 	case "HKCR", "HKEY_CLASSES_ROOT":
-		key = windows.HKEY_CLASSES_ROOT
+		root = windows.HKEY_CLASSES_ROOT
 	case "HKCC", "HKEY_CURRENT_CONFIG":
-		key = windows.HKEY_CURRENT_CONFIG
+		root = windows.HKEY_CURRENT_CONFIG
 	case "HKCU", "HKEY_CURRENT_USER":
-		key = windows.HKEY_CURRENT_USER
+		root = windows.HKEY_CURRENT_USER
 	case "HKLM", "HKEY_LOCAL_MACHINE":
-		key = windows.HKEY_LOCAL_MACHINE
+		root = windows.HKEY_LOCAL_MACHINE
 	case "HKU", "HKEY_USERS":
-		key = windows.HKEY_USERS
+		root = windows.HKEY_USERS
 	default:
 		errorLogMsg := fmt.Sprintf("Error, unknown registry key: '%s'", rootKey)
-		env.Log(Error, "WindowsRegistryKeyValue", errorLogMsg)
-		return nil, errors.New(errorLogMsg)
+		return 0, "", "", errors.New(errorLogMsg)
 	}
 
-	k, err := registry.OpenKey(key, regPath, registry.READ)
-	if err != nil {
-		env.Log(Error, "WindowsRegistryKeyValue", err.Error())
-		return nil, err
-	}
+	return root, regPath, regKey, nil
+}
+
+// readRegistryValue reads regKey from an already-open key, formatting it the
+// same way WindowsRegistryKeyValue does.
+func readRegistryValue(k registry.Key, regKey string) (*WindowsRegistryValue, error) {
 	_, valType, err := k.GetValue(regKey, nil)
 	if err != nil {
-		env.Log(Error, "WindowsRegistryKeyValue", err.Error())
 		return nil, err
 	}
 
@@ -211,16 +433,533 @@ func (env *ShellEnvironment) WindowsRegistryKeyValue(path string) (*WindowsRegis
 	case windows.REG_BINARY:
 		value, _, _ := k.GetBinaryValue(regKey)
 		regValue = &WindowsRegistryValue{ValueType: BINARY, String: string(value)}
+	case windows.REG_MULTI_SZ:
+		values, _, _ := k.GetStringsValue(regKey)
+		regValue = &WindowsRegistryValue{ValueType: MULTISTRING, Strings: values, String: strings.Join(values, "; ")}
 	}
 
 	if regValue == nil {
-		errorLogMsg := fmt.Sprintf("Error, no formatter for type: %d", valType)
-		return nil, errors.New(errorLogMsg)
+		return nil, fmt.Errorf("Error, no formatter for type: %d", valType)
 	}
+
+	return regValue, nil
+}
+
+// WindowsRegistryKeyValue takes a registry path to a key like
+//
+//	"HKLM\Software\Microsoft\Windows NT\CurrentVersion\EditionID"
+//
+// The last part of the path is the key to retrieve.
+//
+// If the path ends in "\", the "(Default)" key in that path is retrieved.
+//
+// Returns a variant type if successful; nil and an error if not.
+func (env *ShellEnvironment) WindowsRegistryKeyValue(path string) (*WindowsRegistryValue, error) {
+	env.Trace(time.Now(), "WindowsRegistryKeyValue", path)
+
+	// A path may carry a "?timeout=<duration>" suffix (e.g. "...\Foo?timeout=5s")
+	// telling us to wait for the key to appear, up to that duration, instead of
+	// failing immediately. This is for adapter- or device-scoped subtrees that
+	// only show up once an interface comes up. Strip it up front so the cache
+	// key below is the same on lookup and on store.
+	var waitTimeout time.Duration
+	if base, query, found := strings.Cut(path, "?timeout="); found {
+		if d, err := time.ParseDuration(query); err == nil {
+			path = base
+			waitTimeout = d
+		}
+	}
+
+	// RegistryCache is a CmdFlags field, defined alongside TerminalWidth et al.
+	// in shell.go, not in this platform-specific file.
+	if env.CmdFlags.RegistryCache {
+		registryCacheLoad.Do(func() { loadRegistryCache(env) })
+		if value, ok := getCachedRegistryValue(path); ok {
+			env.Log(Debug, "WindowsRegistryKeyValue", fmt.Sprintf("cache hit: %s", path))
+			return value, nil
+		}
+	}
+
+	key, regPath, regKey, err := parseRegistryPath(env, path)
+	if err != nil {
+		env.Log(Error, "WindowsRegistryKeyValue", err.Error())
+		return nil, err
+	}
+
+	k, err := registry.OpenKey(key, regPath, registry.READ)
+	if err != nil && waitTimeout > 0 {
+		k, err = OpenRegistryKeyWait(key, regPath, waitTimeout)
+	}
+	if err != nil {
+		env.Log(Error, "WindowsRegistryKeyValue", err.Error())
+		return nil, err
+	}
+	defer k.Close()
+
+	regValue, err := readRegistryValue(k, regKey)
+	if err != nil {
+		env.Log(Error, "WindowsRegistryKeyValue", err.Error())
+		return nil, err
+	}
+
 	env.Log(Debug, "WindowsRegistryKeyValue", fmt.Sprintf("%s(%s): %s", regKey, regValue.ValueType, regValue.String))
+
+	if env.CmdFlags.RegistryCache {
+		cacheRegistryValue(env, key, regPath, path, k, regValue)
+	}
+
 	return regValue, nil
 }
 
+// WindowsRegistryKeyValues reads multiple values in one call, opening each
+// unique parent key only once instead of once per value. This is measurably
+// faster than repeated WindowsRegistryKeyValue calls for themes that read
+// several values under the same key, e.g.
+// HKLM\SOFTWARE\Microsoft\Windows NT\CurrentVersion. Entries that fail to
+// resolve come back as nil at their index.
+func (env *ShellEnvironment) WindowsRegistryKeyValues(paths []string) ([]*WindowsRegistryValue, error) {
+	env.Trace(time.Now(), "WindowsRegistryKeyValues")
+
+	type parsed struct {
+		root   registry.Key
+		path   string
+		regKey string
+	}
+
+	results := make([]*WindowsRegistryValue, len(paths))
+	entries := make([]parsed, len(paths))
+	grouped := map[string][]int{}
+
+	for i, path := range paths {
+		root, regPath, regKey, err := parseRegistryPath(env, path)
+		if err != nil {
+			env.Log(Error, "WindowsRegistryKeyValues", err.Error())
+			continue
+		}
+		entries[i] = parsed{root, regPath, regKey}
+		groupKey := fmt.Sprintf("%d\\%s", root, regPath)
+		grouped[groupKey] = append(grouped[groupKey], i)
+	}
+
+	for _, indices := range grouped {
+		p := entries[indices[0]]
+
+		k, err := registry.OpenKey(p.root, p.path, registry.READ)
+		if err != nil {
+			env.Log(Error, "WindowsRegistryKeyValues", err.Error())
+			continue
+		}
+
+		for _, i := range indices {
+			value, err := readRegistryValue(k, entries[i].regKey)
+			if err != nil {
+				env.Log(Error, "WindowsRegistryKeyValues", err.Error())
+				continue
+			}
+			results[i] = value
+		}
+
+		k.Close()
+	}
+
+	return results, nil
+}
+
+// registryCacheEntry pairs a cached value with the parent key it came from,
+// its LastWriteTime at the moment it was cached (the source of truth for
+// staleness, since it's what we persist and what survives a process
+// restart), and the watcher generation it was last verified against (an
+// in-process fast path that avoids re-querying LastWriteTime on every read
+// once a watcher is live). verified is never persisted: a freshly loaded
+// entry always needs one LastWriteTime check before being trusted, since its
+// Generation is meaningless once the process that wrote it is gone.
+type registryCacheEntry struct {
+	Value      *WindowsRegistryValue
+	Root       registry.Key
+	ParentPath string
+	ModTime    int64
+	Generation uint64
+	verified   bool
+}
+
+const registryCacheFileName = "registry.cache.json"
+
+var (
+	registryCacheMu   sync.Mutex
+	registryCache     = map[string]*registryCacheEntry{}
+	registryCacheLoad sync.Once
+
+	registryWatchMu  sync.Mutex
+	registryWatchGen = map[string]*uint64{}
+)
+
+// watchRegistryParent spawns (once per unique parent key) a goroutine that
+// blocks on RegNotifyChangeKeyValue for REG_NOTIFY_CHANGE_LAST_SET and bumps
+// a generation counter every time it fires. Within a single process this
+// lets getCachedRegistryValue skip re-querying LastWriteTime: as long as the
+// generation hasn't moved since the entry was last verified, nothing has
+// changed.
+func watchRegistryParent(root registry.Key, parentPath string) *uint64 {
+	registryWatchMu.Lock()
+	defer registryWatchMu.Unlock()
+
+	watchKey := fmt.Sprintf("%d\\%s", root, parentPath)
+	if gen, ok := registryWatchGen[watchKey]; ok {
+		return gen
+	}
+
+	gen := new(uint64)
+	registryWatchGen[watchKey] = gen
+
+	go func() {
+		for {
+			k, err := registry.OpenKey(root, parentPath, registry.NOTIFY)
+			if err != nil {
+				return
+			}
+			err = regNotifyChangeKeyValue(k, false, regNotifyChangeLastSet, 0, false)
+			k.Close()
+			if err != nil {
+				return
+			}
+			atomic.AddUint64(gen, 1)
+		}
+	}()
+
+	return gen
+}
+
+// registryKeyModTime returns a key's LastWriteTime, the one piece of state
+// that's actually comparable across process restarts.
+func registryKeyModTime(root registry.Key, parentPath string) (int64, error) {
+	k, err := registry.OpenKey(root, parentPath, registry.QUERY_VALUE)
+	if err != nil {
+		return 0, err
+	}
+	defer k.Close()
+	return keyModTime(k)
+}
+
+func keyModTime(k registry.Key) (int64, error) {
+	info, err := k.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.ModTime().UnixNano(), nil
+}
+
+// registryCacheFileEntry is the on-disk shape of a cache entry. Generation
+// is written out and read back, but isn't meaningful once persisted (the
+// process that recorded it is gone by the time it's read back): a loaded
+// entry is always re-checked against ModTime first, and its Generation is
+// then replaced with the live watcher's.
+type registryCacheFileEntry struct {
+	Value      *WindowsRegistryValue `json:"value"`
+	Root       registry.Key          `json:"root"`
+	ParentPath string                `json:"parentPath"`
+	ModTime    int64                 `json:"modTime"`
+	Generation uint64                `json:"generation"`
+}
+
+func loadRegistryCache(env *ShellEnvironment) {
+	data, err := os.ReadFile(filepath.Join(env.CachePath(), registryCacheFileName))
+	if err != nil {
+		return
+	}
+
+	entries := map[string]*registryCacheFileEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return
+	}
+
+	registryCacheMu.Lock()
+	defer registryCacheMu.Unlock()
+	for path, entry := range entries {
+		registryCache[path] = &registryCacheEntry{
+			Value:      entry.Value,
+			Root:       entry.Root,
+			ParentPath: entry.ParentPath,
+			ModTime:    entry.ModTime,
+			Generation: entry.Generation,
+			// verified stays false: this process hasn't confirmed the
+			// registry still matches ModTime yet.
+		}
+	}
+}
+
+func saveRegistryCache(env *ShellEnvironment) {
+	registryCacheMu.Lock()
+	entries := make(map[string]*registryCacheFileEntry, len(registryCache))
+	for path, entry := range registryCache {
+		entries[path] = &registryCacheFileEntry{
+			Value:      entry.Value,
+			Root:       entry.Root,
+			ParentPath: entry.ParentPath,
+			ModTime:    entry.ModTime,
+			Generation: entry.Generation,
+		}
+	}
+	registryCacheMu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+
+	_ = os.WriteFile(filepath.Join(env.CachePath(), registryCacheFileName), data, 0o644)
+}
+
+// getCachedRegistryValue returns the cached value for path if it's still
+// fresh. An entry not yet verified in this process (e.g. one just loaded
+// from disk) is checked once against the key's live LastWriteTime, since its
+// Generation was recorded by a process that no longer exists. Once verified,
+// later calls in the same process serve the entry without touching the
+// registry until watchRegistryParent's generation counter moves (i.e. a
+// REG_NOTIFY_CHANGE_LAST_SET actually fired); the entry is then dropped and
+// the call reports a miss.
+func getCachedRegistryValue(path string) (*WindowsRegistryValue, bool) {
+	registryCacheMu.Lock()
+	entry, ok := registryCache[path]
+	registryCacheMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	gen := watchRegistryParent(entry.Root, entry.ParentPath)
+	live := atomic.LoadUint64(gen)
+
+	registryCacheMu.Lock()
+	needsVerify := !entry.verified
+	changedSinceVerified := entry.verified && live != entry.Generation
+	registryCacheMu.Unlock()
+
+	if changedSinceVerified {
+		registryCacheMu.Lock()
+		delete(registryCache, path)
+		registryCacheMu.Unlock()
+		return nil, false
+	}
+
+	if needsVerify {
+		modTime, err := registryKeyModTime(entry.Root, entry.ParentPath)
+		if err != nil || modTime != entry.ModTime {
+			registryCacheMu.Lock()
+			delete(registryCache, path)
+			registryCacheMu.Unlock()
+			return nil, false
+		}
+
+		registryCacheMu.Lock()
+		entry.Generation = live
+		entry.verified = true
+		registryCacheMu.Unlock()
+	}
+
+	return entry.Value, true
+}
+
+// cacheRegistryValue caches value under fullPath, recording the parent key's
+// current LastWriteTime (read from the already-open key k) so a later
+// process can tell whether the key changed since.
+func cacheRegistryValue(env *ShellEnvironment, root registry.Key, regPath, fullPath string, k registry.Key, value *WindowsRegistryValue) {
+	gen := watchRegistryParent(root, regPath)
+
+	modTime, err := keyModTime(k)
+	if err != nil {
+		env.Log(Error, "cacheRegistryValue", err.Error())
+		return
+	}
+
+	registryCacheMu.Lock()
+	registryCache[fullPath] = &registryCacheEntry{
+		Value:      value,
+		Root:       root,
+		ParentPath: regPath,
+		ModTime:    modTime,
+		Generation: atomic.LoadUint64(gen),
+		verified:   true,
+	}
+	registryCacheMu.Unlock()
+
+	saveRegistryCache(env)
+}
+
+// RegistryValueSource identifies which layer of a policy-aware lookup
+// actually supplied a value, so segments can surface it in .debug output.
+type RegistryValueSource string
+
+const (
+	RegistrySourceMachinePolicy RegistryValueSource = "HKLM Policy"
+	RegistrySourceUserPolicy    RegistryValueSource = "HKCU Policy"
+	RegistrySourceUser          RegistryValueSource = "User"
+)
+
+// ResolvedRegistryValue wraps a WindowsRegistryValue with the layer that
+// supplied it.
+type ResolvedRegistryValue struct {
+	*WindowsRegistryValue
+	Source RegistryValueSource
+}
+
+// WindowsRegistryKeyValueWithPolicy resolves a value the way Windows apps
+// honor Group Policy: HKLM\SOFTWARE\Policies\<vendor>\<name> wins if present,
+// then HKCU\SOFTWARE\Policies\<vendor>\<name>, and only then the caller's own
+// path. This lets segment authors read a value that admins can centrally pin
+// via GPO while still allowing per-user configuration.
+func (env *ShellEnvironment) WindowsRegistryKeyValueWithPolicy(vendor, name, path string) (*ResolvedRegistryValue, error) {
+	env.Trace(time.Now(), "WindowsRegistryKeyValueWithPolicy", path)
+
+	policyPath := fmt.Sprintf(`SOFTWARE\Policies\%s\%s`, vendor, name)
+
+	candidates := []struct {
+		path   string
+		source RegistryValueSource
+	}{
+		{`HKLM\` + policyPath, RegistrySourceMachinePolicy},
+		{`HKCU\` + policyPath, RegistrySourceUserPolicy},
+		{path, RegistrySourceUser},
+	}
+
+	var lastErr error
+	for _, candidate := range candidates {
+		value, err := env.WindowsRegistryKeyValue(candidate.path)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		env.Log(Debug, "WindowsRegistryKeyValueWithPolicy", fmt.Sprintf("resolved %s from %s", path, candidate.source))
+		return &ResolvedRegistryValue{WindowsRegistryValue: value, Source: candidate.source}, nil
+	}
+
+	return nil, lastErr
+}
+
+var (
+	advapi32                    = windows.NewLazySystemDLL("advapi32.dll")
+	procRegNotifyChangeKeyValue = advapi32.NewProc("RegNotifyChangeKeyValue")
+)
+
+const (
+	regNotifyChangeName    = 0x00000001
+	regNotifyChangeLastSet = 0x00000004
+)
+
+// regNotifyChangeKeyValue wraps RegNotifyChangeKeyValue. When async is true
+// and event is a valid handle, the call returns immediately and signals event
+// once a matching change occurs; when async is false, it blocks the caller
+// until the change fires.
+func regNotifyChangeKeyValue(key registry.Key, watchSubtree bool, filter uint32, event windows.Handle, async bool) error {
+	watch := uintptr(0)
+	if watchSubtree {
+		watch = 1
+	}
+	isAsync := uintptr(0)
+	if async {
+		isAsync = 1
+	}
+	r, _, _ := procRegNotifyChangeKeyValue.Call(uintptr(key), watch, uintptr(filter), uintptr(event), isAsync)
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+// nearestExistingRegistryParent walks path upwards until it finds a key that
+// already exists, returning a handle opened for change notifications.
+func nearestExistingRegistryParent(root registry.Key, path string) (registry.Key, error) {
+	for {
+		idx := strings.LastIndex(path, `\`)
+		if idx < 0 {
+			return registry.OpenKey(root, "", registry.NOTIFY)
+		}
+		path = path[:idx]
+		if k, err := registry.OpenKey(root, path, registry.NOTIFY); err == nil {
+			return k, nil
+		}
+	}
+}
+
+// waitForRegistryChild blocks until a child key is created under the nearest
+// existing ancestor of path, or until timeout elapses.
+func waitForRegistryChild(root registry.Key, path string, timeout time.Duration) error {
+	parent, err := nearestExistingRegistryParent(root, path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	event, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(event)
+
+	if err := regNotifyChangeKeyValue(parent, false, regNotifyChangeName, event, true); err != nil {
+		return err
+	}
+
+	s, err := windows.WaitForSingleObject(event, uint32(timeout.Milliseconds()))
+	if err != nil {
+		return err
+	}
+	if s != windows.WAIT_OBJECT_0 {
+		return errors.New("timeout waiting for registry key")
+	}
+	return nil
+}
+
+// OpenRegistryKeyWait polls registry.OpenKey for up to timeout, backing off
+// from 50ms to a 1s cap between attempts. When the path doesn't exist yet, it
+// blocks on RegNotifyChangeKeyValue against the nearest existing parent
+// instead of busy-looping, retrying as soon as a child key is created. This
+// is meant for adapter- or device-scoped subtrees, e.g. under
+// SYSTEM\CurrentControlSet\Services\Tcpip\Parameters\Interfaces\{GUID}, that
+// only appear seconds after the interface comes up.
+func OpenRegistryKeyWait(root registry.Key, path string, timeout time.Duration) (registry.Key, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := 50 * time.Millisecond
+
+	for {
+		k, err := registry.OpenKey(root, path, registry.READ)
+		if err == nil {
+			return k, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, err
+		}
+
+		if waitErr := waitForRegistryChild(root, path, remaining); waitErr != nil {
+			// waitForRegistryChild already blocked up to remaining, so the
+			// deadline may already be gone; only back off with whatever time
+			// is actually left, instead of silently extending the caller's
+			// timeout.
+			remaining = time.Until(deadline)
+			if remaining <= 0 {
+				return 0, waitErr
+			}
+
+			sleep := backoff
+			if sleep > remaining {
+				sleep = remaining
+			}
+			time.Sleep(sleep)
+			backoff *= 2
+			if backoff > time.Second {
+				backoff = time.Second
+			}
+		}
+	}
+}
+
+// OpenRegistryKeyWait exposes OpenRegistryKeyWait on ShellEnvironment for
+// segments that need to wait on an ephemeral registry path themselves.
+func (env *ShellEnvironment) OpenRegistryKeyWait(root registry.Key, path string, timeout time.Duration) (registry.Key, error) {
+	env.Trace(time.Now(), "OpenRegistryKeyWait", path)
+	return OpenRegistryKeyWait(root, path, timeout)
+}
+
 func (env *ShellEnvironment) InWSLSharedDrive() bool {
 	return false
 }
@@ -270,4 +1009,106 @@ func (env *ShellEnvironment) Connection(connectionType ConnectionType) (*Connect
 	}
 	env.Log(Error, "network", fmt.Sprintf("Network type '%s' not found", connectionType))
 	return nil, &NotImplemented{}
+}
+
+// PathOp is the operation ModifyUserPath performs on an entry of
+// HKCU\Environment\Path.
+type PathOp int
+
+const (
+	PathPrepend PathOp = iota
+	PathAppend
+	PathRemove
+)
+
+const (
+	wmSettingChange = 0x001A
+	smtoAbortIfHung = 0x0002
+	hwndBroadcast   = 0xFFFF
+)
+
+var procSendMessageTimeoutW = user32.NewProc("SendMessageTimeoutW")
+
+func broadcastEnvironmentChange() {
+	environment, err := syscall.UTF16PtrFromString("Environment")
+	if err != nil {
+		return
+	}
+	var result uintptr
+	_, _, _ = procSendMessageTimeoutW.Call(
+		hwndBroadcast,
+		wmSettingChange,
+		0,
+		uintptr(unsafe.Pointer(environment)),
+		smtoAbortIfHung,
+		5000,
+		uintptr(unsafe.Pointer(&result)),
+	)
+}
+
+func splitPathEntries(path string) []string {
+	if len(path) == 0 {
+		return nil
+	}
+	parts := strings.Split(path, ";")
+	entries := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if len(part) > 0 {
+			entries = append(entries, part)
+		}
+	}
+	return entries
+}
+
+func removePathEntry(entries []string, dir string) []string {
+	filtered := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.EqualFold(entry, dir) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// ModifyUserPath prepends, appends, or removes dir in HKCU\Environment\Path,
+// deduplicating case-insensitively and preserving the value as REG_EXPAND_SZ
+// so "%…%" tokens already present aren't expanded away. It then broadcasts
+// WM_SETTINGCHANGE so already-running shells (Explorer included) pick up the
+// change without a logout. This replaces shelling out to setx, which
+// truncates values over 1024 characters and silently downgrades
+// REG_EXPAND_SZ to REG_SZ.
+func (env *ShellEnvironment) ModifyUserPath(op PathOp, dir string) error {
+	defer env.Trace(time.Now(), "ModifyUserPath", dir)
+
+	k, err := registry.OpenKey(windows.HKEY_CURRENT_USER, `Environment`, registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		env.Log(Error, "ModifyUserPath", err.Error())
+		return err
+	}
+	defer k.Close()
+
+	current, _, err := k.GetStringValue("Path")
+	if err != nil && !errors.Is(err, registry.ErrNotExist) {
+		env.Log(Error, "ModifyUserPath", err.Error())
+		return err
+	}
+
+	entries := removePathEntry(splitPathEntries(current), dir)
+
+	switch op {
+	case PathPrepend:
+		entries = append([]string{dir}, entries...)
+	case PathAppend:
+		entries = append(entries, dir)
+	case PathRemove:
+		// already removed above
+	}
+
+	if err := k.SetExpandStringValue("Path", strings.Join(entries, ";")); err != nil {
+		env.Log(Error, "ModifyUserPath", err.Error())
+		return err
+	}
+
+	broadcastEnvironmentChange()
+	return nil
 }
\ No newline at end of file
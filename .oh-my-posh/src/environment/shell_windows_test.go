@@ -0,0 +1,125 @@
+package environment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/windows/registry"
+)
+
+// openTestKey creates a throwaway key under HKCU\Software to read registry
+// values back from, and registers its cleanup.
+func openTestKey(t *testing.T) registry.Key {
+	t.Helper()
+
+	k, _, err := registry.CreateKey(registry.CURRENT_USER, `Software\oh-my-posh-test`, registry.ALL_ACCESS)
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		k.Close()
+		_ = registry.DeleteKey(registry.CURRENT_USER, `Software\oh-my-posh-test`)
+	})
+
+	return k
+}
+
+func TestReadRegistryValue_MissingKey(t *testing.T) {
+	k := openTestKey(t)
+
+	_, err := readRegistryValue(k, "DoesNotExist")
+	assert.Error(t, err)
+}
+
+func TestReadRegistryValue_WrongTypeOverride(t *testing.T) {
+	k := openTestKey(t)
+
+	assert.NoError(t, k.SetDWordValue("AsDword", 42))
+
+	value, err := readRegistryValue(k, "AsDword")
+	assert.NoError(t, err)
+	assert.Equal(t, DWORD, value.ValueType)
+	assert.Equal(t, uint64(42), value.DWord)
+
+	// Overwrite the same value name with a different type; the reader must
+	// pick up the new type rather than keep treating it as a DWORD.
+	assert.NoError(t, k.SetStringValue("AsDword", "now a string"))
+
+	value, err = readRegistryValue(k, "AsDword")
+	assert.NoError(t, err)
+	assert.Equal(t, STRING, value.ValueType)
+	assert.Equal(t, "now a string", value.String)
+}
+
+// resetRegistryCacheState wipes the package-level cache/watcher maps, the
+// same state a brand new process starts with, so a test can simulate
+// multiple "process lifetimes" within a single test binary.
+func resetRegistryCacheState(t *testing.T) {
+	t.Helper()
+
+	registryCacheMu.Lock()
+	registryCache = map[string]*registryCacheEntry{}
+	registryCacheMu.Unlock()
+
+	registryWatchMu.Lock()
+	registryWatchGen = map[string]*uint64{}
+	registryWatchMu.Unlock()
+}
+
+func TestGetCachedRegistryValue_StaleAcrossProcessRestart(t *testing.T) {
+	k := openTestKey(t)
+	assert.NoError(t, k.SetStringValue("Cached", "first"))
+
+	regPath := `Software\oh-my-posh-test`
+	fullPath := `HKCU\` + regPath + `\Cached`
+
+	// "Process" 1: read the value and cache it, including its LastWriteTime.
+	resetRegistryCacheState(t)
+	value, err := readRegistryValue(k, "Cached")
+	assert.NoError(t, err)
+	modTime, err := keyModTime(k)
+	assert.NoError(t, err)
+	registryCacheMu.Lock()
+	registryCache[fullPath] = &registryCacheEntry{
+		Value:      value,
+		Root:       registry.CURRENT_USER,
+		ParentPath: regPath,
+		ModTime:    modTime,
+		verified:   true,
+	}
+	registryCacheMu.Unlock()
+
+	// The registry key changes after "process" 1 exits.
+	assert.NoError(t, k.SetStringValue("Cached", "second"))
+
+	// "Process" 2 starts fresh: no watcher has run yet, so a generation
+	// comparison alone would trivially match (both start at 0). Only the
+	// persisted ModTime can reveal the value changed while we weren't
+	// running.
+	resetRegistryCacheState(t)
+	registryCacheMu.Lock()
+	registryCache[fullPath] = &registryCacheEntry{
+		Value:      value,
+		Root:       registry.CURRENT_USER,
+		ParentPath: regPath,
+		ModTime:    modTime,
+		// verified left false, as it would be for an entry just loaded
+		// from disk by a new process.
+	}
+	registryCacheMu.Unlock()
+
+	_, ok := getCachedRegistryValue(fullPath)
+	assert.False(t, ok, "stale entry from a previous process must not be served")
+}
+
+func TestReadRegistryValue_MultiString(t *testing.T) {
+	k := openTestKey(t)
+
+	values := []string{"one", "two", "three"}
+	assert.NoError(t, k.SetStringsValue("Multi", values))
+
+	value, err := readRegistryValue(k, "Multi")
+	assert.NoError(t, err)
+	assert.Equal(t, MULTISTRING, value.ValueType)
+	assert.Equal(t, values, value.Strings)
+	assert.Equal(t, "one; two; three", value.String)
+}